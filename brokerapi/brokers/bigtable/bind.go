@@ -0,0 +1,131 @@
+// Copyright the Service Broker Project Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+////////////////////////////////////////////////////////////////////////////////
+//
+
+package bigtable
+
+import (
+	googlebigtable "cloud.google.com/go/bigtable"
+	"cloud.google.com/go/iam"
+	"encoding/json"
+	"fmt"
+	"gcp-service-broker/brokerapi/brokers/models"
+	"gcp-service-broker/db_service"
+	"golang.org/x/net/context"
+	"google.golang.org/api/option"
+)
+
+// BigtableIAMRoles are the predefined Bigtable roles a binding may request.
+// Unlike BrokerBase.Bind's project-wide role, these are granted on the
+// instance's own IAM policy, so a binding can only act on the instance
+// it was issued for.
+var BigtableIAMRoles = map[string]bool{
+	"roles/bigtable.user":   true,
+	"roles/bigtable.reader": true,
+	"roles/bigtable.admin":  true,
+}
+
+const defaultBindRole = "roles/bigtable.user"
+
+// Bind creates a service account for the given binding and grants it one of
+// BigtableIAMRoles on this instance's Bigtable IAM policy, rather than the
+// project-wide role the embedded BrokerBase.Bind would otherwise grant. The
+// returned credentials carry the instance, project and cluster IDs needed
+// to connect with the Go bigtable client or cbt out of the box.
+func (b *BigTableBroker) Bind(instanceID string, bindingID string, details models.BindDetails) (models.ServiceBindingCredentials, error) {
+	var err error
+	var params map[string]string
+
+	if len(details.RawParameters) == 0 {
+		params = map[string]string{}
+	} else if err = json.Unmarshal(details.RawParameters, &params); err != nil {
+		return models.ServiceBindingCredentials{}, fmt.Errorf("Error unmarshalling parameters: %s", err)
+	}
+
+	role := defaultBindRole
+	if userRole, ok := params["role"]; ok {
+		role = userRole
+	}
+	if !BigtableIAMRoles[role] {
+		return models.ServiceBindingCredentials{}, fmt.Errorf("Error invalid role %q, must be one of roles/bigtable.user, roles/bigtable.reader, roles/bigtable.admin", role)
+	}
+
+	instance := models.ServiceInstanceDetails{}
+	if err = db_service.DbConnection.Where("ID = ?", instanceID).First(&instance).Error; err != nil {
+		return models.ServiceBindingCredentials{}, models.ErrInstanceDoesNotExist
+	}
+
+	var ii InstanceInformation
+	if err = json.Unmarshal([]byte(instance.OtherDetails), &ii); err != nil {
+		return models.ServiceBindingCredentials{}, fmt.Errorf("Error unmarshalling other details: %s", err)
+	}
+
+	// Mint the service account and key through the shared account manager,
+	// but with no project-level roles attached: the grant below scopes
+	// access to just this instance.
+	creds, err := b.AccountManager.CreateAccountWithRoles(instanceID, bindingID, []string{}, instance.Name)
+	if err != nil {
+		return models.ServiceBindingCredentials{}, fmt.Errorf("Error creating service account: %s", err)
+	}
+
+	email, ok := creds["Email"]
+	if !ok {
+		return models.ServiceBindingCredentials{}, fmt.Errorf("Error service account response missing Email")
+	}
+
+	ctx := context.Background()
+	co := option.WithUserAgent(models.CustomUserAgent)
+	service, err := googlebigtable.NewInstanceAdminClient(ctx, b.ProjectId, co)
+	if err != nil {
+		return models.ServiceBindingCredentials{}, fmt.Errorf("Error creating bigtable client: %s", err)
+	}
+
+	handle := service.InstanceIAM(instance.Name)
+	policy, err := handle.Policy(ctx)
+	if err != nil {
+		return models.ServiceBindingCredentials{}, fmt.Errorf("Error fetching instance IAM policy: %s", err)
+	}
+	policy.Add("serviceAccount:"+email, iam.RoleName(role))
+	if err = handle.SetPolicy(ctx, policy); err != nil {
+		return models.ServiceBindingCredentials{}, fmt.Errorf("Error granting %q on instance %q: %s", role, instance.Name, err)
+	}
+
+	clusterIds := []string{ii.ClusterId}
+	if len(ii.Clusters) > 0 {
+		clusterIds = make([]string, len(ii.Clusters))
+		for idx, c := range ii.Clusters {
+			clusterIds[idx] = c.ClusterId
+		}
+	}
+	clusterJson, err := json.Marshal(clusterIds)
+	if err != nil {
+		return models.ServiceBindingCredentials{}, fmt.Errorf("Error marshalling cluster list: %s", err)
+	}
+
+	creds["instance_id"] = instance.Name
+	creds["project_id"] = b.ProjectId
+	creds["role"] = role
+	creds["clusters"] = string(clusterJson)
+
+	otherDetails, err := json.Marshal(creds)
+	if err != nil {
+		return models.ServiceBindingCredentials{}, fmt.Errorf("Error marshalling credentials: %s", err)
+	}
+
+	return models.ServiceBindingCredentials{
+		OtherDetails: string(otherDetails),
+	}, nil
+}
@@ -42,7 +42,13 @@ type BigTableBroker struct {
 }
 
 type InstanceInformation struct {
-	InstanceId string `json:"instance_id"`
+	InstanceId   string        `json:"instance_id"`
+	InstanceType string        `json:"instance_type"`
+	ClusterId    string        `json:"cluster_id,omitempty"`
+	Zone         string        `json:"zone,omitempty"`
+	NumNodes     int32         `json:"num_nodes,omitempty"`
+	StorageType  string        `json:"storage_type,omitempty"`
+	Clusters     []ClusterSpec `json:"clusters,omitempty"`
 }
 
 var StorageTypes = map[string]googlebigtable.StorageType{
@@ -50,21 +56,44 @@ var StorageTypes = map[string]googlebigtable.StorageType{
 	"HDD": googlebigtable.HDD,
 }
 
+var InstanceTypes = map[string]googlebigtable.InstanceType{
+	"DEVELOPMENT": googlebigtable.DEVELOPMENT,
+	"PRODUCTION":  googlebigtable.PRODUCTION,
+}
+
+const defaultInstanceType = "PRODUCTION"
+
+// maxClusters mirrors the Bigtable API limit of four clusters per instance.
+const maxClusters = 4
+
+// ClusterSpec describes a single cluster in a replicated (multi-cluster)
+// Bigtable instance, as supplied via the "clusters" provision parameter.
+type ClusterSpec struct {
+	ClusterId   string `json:"cluster_id"`
+	Zone        string `json:"zone"`
+	NumNodes    int32  `json:"num_nodes"`
+	StorageType string `json:"storage_type"`
+}
+
 // Creates a new Bigtable Instance identified by the name provided in details.RawParameters.name and
 // optional cluster_id (a default will be supplied), display_name, and zone (defaults to us-east1-b)
 func (b *BigTableBroker) Provision(instanceId string, details models.ProvisionDetails, plan models.PlanDetails) (models.ServiceInstanceDetails, error) {
 	var err error
-	var params map[string]string
+	var params map[string]json.RawMessage
 
 	if len(details.RawParameters) == 0 {
-		params = map[string]string{}
+		params = map[string]json.RawMessage{}
 	} else if err = json.Unmarshal(details.RawParameters, &params); err != nil {
 		return models.ServiceInstanceDetails{}, fmt.Errorf("Error unmarshalling parameters: %s", err)
 	}
 
+	var name string
+	if err = unmarshalParam(params, "name", &name); err != nil {
+		return models.ServiceInstanceDetails{}, err
+	}
 	// Ensure there is a name for this instance
-	if _, ok := params["name"]; !ok {
-		params["name"] = name_generator.Basic.InstanceNameWithSeparator("-")
+	if name == "" {
+		name = name_generator.Basic.InstanceNameWithSeparator("-")
 	}
 
 	// get plan parameters
@@ -80,47 +109,134 @@ func (b *BigTableBroker) Provision(instanceId string, details models.ProvisionDe
 		return models.ServiceInstanceDetails{}, fmt.Errorf("Error creating bigtable client: %s", err)
 	}
 
-	var clusterId string
-	if len(params["name"]) > 20 {
-		clusterId = params["name"][:20] + "-cluster"
-	} else {
-		clusterId = params["name"] + "-cluster"
+	var clusters []ClusterSpec
+	if _, ok := params["clusters"]; ok {
+		if err = unmarshalParam(params, "clusters", &clusters); err != nil {
+			return models.ServiceInstanceDetails{}, err
+		}
+
+		if len(clusters) > maxClusters {
+			return models.ServiceInstanceDetails{}, fmt.Errorf("Error too many clusters: Bigtable instances support at most %d clusters", maxClusters)
+		}
+
+		if _, clusterIdOk := params["cluster_id"]; clusterIdOk {
+			return models.ServiceInstanceDetails{}, fmt.Errorf("Error clusters cannot be combined with cluster_id, use a cluster_id entry per cluster instead")
+		}
+		if _, zoneOk := params["zone"]; zoneOk {
+			return models.ServiceInstanceDetails{}, fmt.Errorf("Error clusters cannot be combined with zone, use a zone entry per cluster instead")
+		}
+	}
+
+	var userClusterId string
+	if err = unmarshalParam(params, "cluster_id", &userClusterId); err != nil {
+		return models.ServiceInstanceDetails{}, err
 	}
-	if userClusterId, clusterIdOk := params["cluster_id"]; clusterIdOk {
-		clusterId = userClusterId
+	clusterId := userClusterId
+	if clusterId == "" {
+		if len(name) > 20 {
+			clusterId = name[:20] + "-cluster"
+		} else {
+			clusterId = name + "-cluster"
+		}
 	}
 
-	numNodes, err := strconv.Atoi(planDetails["num_nodes"])
-	if err != nil {
-		return models.ServiceInstanceDetails{}, fmt.Errorf("Error converting num_nodes to int: %s", err)
+	var instanceType string
+	if err = unmarshalParam(params, "instance_type", &instanceType); err != nil {
+		return models.ServiceInstanceDetails{}, err
+	}
+	if instanceType == "" {
+		if planInstanceType, planInstanceTypeOk := planDetails["instance_type"]; planInstanceTypeOk && planInstanceType != "" {
+			instanceType = planInstanceType
+		} else {
+			instanceType = defaultInstanceType
+		}
 	}
 
-	zone := "us-east1-b"
-	if userZone, userZoneOk := params["zone"]; userZoneOk {
-		zone = userZone
+	if _, ok := InstanceTypes[instanceType]; !ok {
+		return models.ServiceInstanceDetails{}, fmt.Errorf("Error invalid instance_type %q, must be one of DEVELOPMENT or PRODUCTION", instanceType)
 	}
 
-	displayName := params["name"]
-	if userDisplayName, userDisplayNameOk := params["display_name"]; userDisplayNameOk {
-		displayName = userDisplayName
+	if instanceType == "DEVELOPMENT" && len(clusters) > 0 {
+		return models.ServiceInstanceDetails{}, fmt.Errorf("Error DEVELOPMENT instances only support a single cluster, clusters cannot be used with instance_type=DEVELOPMENT")
 	}
 
-	ic := googlebigtable.InstanceConf{
-		InstanceId:  params["name"],
-		ClusterId:   clusterId,
-		NumNodes:    int32(numNodes),
-		StorageType: StorageTypes[planDetails["storage_type"]],
-		Zone:        zone,
-		DisplayName: displayName,
+	// Development instances are always single-node, so num_nodes is only
+	// required (and meaningful) for production instances. Multi-cluster
+	// instances carry their own per-cluster NumNodes, so the plan-level
+	// num_nodes feature doesn't apply there either.
+	var numNodes int
+	if len(clusters) == 0 && instanceType != "DEVELOPMENT" {
+		numNodes, err = strconv.Atoi(planDetails["num_nodes"])
+		if err != nil {
+			return models.ServiceInstanceDetails{}, fmt.Errorf("Error converting num_nodes to int: %s", err)
+		}
 	}
 
-	err = service.CreateInstance(ctx, &ic)
-	if err != nil {
-		return models.ServiceInstanceDetails{}, fmt.Errorf("Error creating new instance: %s", err)
+	var zone string
+	if err = unmarshalParam(params, "zone", &zone); err != nil {
+		return models.ServiceInstanceDetails{}, err
+	}
+	if zone == "" {
+		zone = "us-east1-b"
+	}
+
+	displayName := name
+	var userDisplayName string
+	if err = unmarshalParam(params, "display_name", &userDisplayName); err != nil {
+		return models.ServiceInstanceDetails{}, err
+	}
+	if userDisplayName != "" {
+		displayName = userDisplayName
+	}
+
+	if len(clusters) > 0 {
+		clusterConfigs := make([]googlebigtable.ClusterConfig, len(clusters))
+		for idx, c := range clusters {
+			clusterConfigs[idx] = googlebigtable.ClusterConfig{
+				InstanceID:  name,
+				ClusterID:   c.ClusterId,
+				Zone:        c.Zone,
+				NumNodes:    c.NumNodes,
+				StorageType: StorageTypes[c.StorageType],
+			}
+		}
+
+		icc := googlebigtable.InstanceWithClustersConfig{
+			InstanceID:   name,
+			DisplayName:  displayName,
+			Clusters:     clusterConfigs,
+			InstanceType: InstanceTypes[instanceType],
+		}
+
+		if err = service.CreateInstanceWithClusters(ctx, &icc); err != nil {
+			return models.ServiceInstanceDetails{}, fmt.Errorf("Error creating new instance: %s", err)
+		}
+	} else {
+		ic := googlebigtable.InstanceConf{
+			InstanceId:   name,
+			ClusterId:    clusterId,
+			NumNodes:     int32(numNodes),
+			StorageType:  StorageTypes[planDetails["storage_type"]],
+			Zone:         zone,
+			DisplayName:  displayName,
+			InstanceType: InstanceTypes[instanceType],
+		}
+
+		if err = service.CreateInstance(ctx, &ic); err != nil {
+			return models.ServiceInstanceDetails{}, fmt.Errorf("Error creating new instance: %s", err)
+		}
 	}
 
 	ii := InstanceInformation{
-		InstanceId: params["name"],
+		InstanceId:   name,
+		InstanceType: instanceType,
+		Clusters:     clusters,
+	}
+	if len(clusters) == 0 {
+		ii.ClusterId = clusterId
+		ii.Zone = zone
+		ii.NumNodes = int32(numNodes)
+		ii.StorageType = planDetails["storage_type"]
 	}
 
 	otherDetails, err := json.Marshal(ii)
@@ -129,7 +245,7 @@ func (b *BigTableBroker) Provision(instanceId string, details models.ProvisionDe
 	}
 
 	i := models.ServiceInstanceDetails{
-		Name:         params["name"],
+		Name:         name,
 		Url:          "",
 		Location:     "",
 		OtherDetails: string(otherDetails),
@@ -159,14 +275,215 @@ func (b *BigTableBroker) Deprovision(instanceID string, details models.Deprovisi
 	return nil
 }
 
+// existingClusters returns the cluster topology currently recorded for an
+// instance, keyed by cluster ID. It seeds the legacy single-cluster field
+// (ClusterId/Zone/NumNodes/StorageType) alongside Clusters so a single-cluster
+// instance being replicated for the first time doesn't lose track of the
+// cluster it already has.
+func existingClusters(ii InstanceInformation) map[string]ClusterSpec {
+	existing := map[string]ClusterSpec{}
+
+	if ii.ClusterId != "" {
+		existing[ii.ClusterId] = ClusterSpec{
+			ClusterId:   ii.ClusterId,
+			Zone:        ii.Zone,
+			NumNodes:    ii.NumNodes,
+			StorageType: ii.StorageType,
+		}
+	}
+	for _, c := range ii.Clusters {
+		existing[c.ClusterId] = c
+	}
+
+	return existing
+}
+
+// reconcileClusters diffs the currently recorded clusters against the
+// desired list and returns which clusters need to be created, resized, or
+// removed to get from one to the other. Clusters are matched by ID and only
+// NumNodes is compared; a changed zone or storage type on an existing
+// cluster is not reported.
+func reconcileClusters(existing map[string]ClusterSpec, desired []ClusterSpec) (toCreate, toUpdate []ClusterSpec, toDelete []string) {
+	desiredById := map[string]ClusterSpec{}
+	for _, c := range desired {
+		desiredById[c.ClusterId] = c
+	}
+
+	for _, c := range desired {
+		old, ok := existing[c.ClusterId]
+		switch {
+		case !ok:
+			toCreate = append(toCreate, c)
+		case old.NumNodes != c.NumNodes:
+			toUpdate = append(toUpdate, c)
+		}
+	}
+
+	for id := range existing {
+		if _, ok := desiredById[id]; !ok {
+			toDelete = append(toDelete, id)
+		}
+	}
+
+	return toCreate, toUpdate, toDelete
+}
+
+// validateNumNodes rejects node counts outside what the plan allows.
+// maxNodes of 0 means the plan didn't configure a bound, so any positive
+// count is accepted.
+func validateNumNodes(numNodes int32, maxNodes int) error {
+	if numNodes < 1 {
+		return fmt.Errorf("Error num_nodes must be at least 1, got %d", numNodes)
+	}
+	if maxNodes > 0 && int(numNodes) > maxNodes {
+		return fmt.Errorf("Error num_nodes %d exceeds plan bound of %d", numNodes, maxNodes)
+	}
+	return nil
+}
+
+// UpdateParameters is the shape of the RawParameters accepted by Update: a
+// node-count resize for the existing cluster, or (for PRODUCTION instances)
+// a new set of replica clusters.
+type UpdateParameters struct {
+	NumNodes *int32        `json:"num_nodes"`
+	Clusters []ClusterSpec `json:"clusters"`
+}
+
+// Resizes an existing instance's cluster(s). Operators may change num_nodes
+// on the current cluster, or, for PRODUCTION instances, add/remove replica
+// clusters by supplying a new clusters list.
+func (b *BigTableBroker) Update(instanceID string, details models.UpdateDetails, plan models.PlanDetails) error {
+	var err error
+	var params UpdateParameters
+
+	if len(details.RawParameters) == 0 {
+		return nil
+	}
+	if err = json.Unmarshal(details.RawParameters, &params); err != nil {
+		return fmt.Errorf("Error unmarshalling parameters: %s", err)
+	}
+
+	instance := models.ServiceInstanceDetails{}
+	if err = db_service.DbConnection.Where("ID = ?", instanceID).First(&instance).Error; err != nil {
+		return models.ErrInstanceDoesNotExist
+	}
+
+	var ii InstanceInformation
+	if err = json.Unmarshal([]byte(instance.OtherDetails), &ii); err != nil {
+		return fmt.Errorf("Error unmarshalling other details: %s", err)
+	}
+
+	// get plan parameters, same as Provision, so resizes stay within the
+	// bounds the plan was configured for.
+	var planDetails map[string]string
+	if err = json.Unmarshal([]byte(plan.Features), &planDetails); err != nil {
+		return fmt.Errorf("Error unmarshalling plan features: %s", err)
+	}
+
+	var maxNodes int
+	if rawMaxNodes, ok := planDetails["num_nodes"]; ok && rawMaxNodes != "" {
+		maxNodes, err = strconv.Atoi(rawMaxNodes)
+		if err != nil {
+			return fmt.Errorf("Error converting plan num_nodes to int: %s", err)
+		}
+	}
+
+	ctx := context.Background()
+	co := option.WithUserAgent(models.CustomUserAgent)
+	service, err := googlebigtable.NewInstanceAdminClient(ctx, b.ProjectId, co)
+	if err != nil {
+		return fmt.Errorf("Error creating bigtable client: %s", err)
+	}
+
+	switch {
+	case len(params.Clusters) > 0:
+		if ii.InstanceType != "PRODUCTION" {
+			return fmt.Errorf("Error replica clusters can only be added to PRODUCTION instances")
+		}
+		if len(params.Clusters) > maxClusters {
+			return fmt.Errorf("Error too many clusters: Bigtable instances support at most %d clusters", maxClusters)
+		}
+		for _, c := range params.Clusters {
+			if err = validateNumNodes(c.NumNodes, maxNodes); err != nil {
+				return err
+			}
+		}
+
+		toCreate, toUpdate, toDelete := reconcileClusters(existingClusters(ii), params.Clusters)
+
+		for _, c := range toCreate {
+			cc := googlebigtable.ClusterConfig{
+				InstanceID:  instance.Name,
+				ClusterID:   c.ClusterId,
+				Zone:        c.Zone,
+				NumNodes:    c.NumNodes,
+				StorageType: StorageTypes[c.StorageType],
+			}
+			if err = service.CreateCluster(ctx, &cc); err != nil {
+				return fmt.Errorf("Error creating replica cluster %q: %s", c.ClusterId, err)
+			}
+		}
+
+		for _, c := range toUpdate {
+			if err = service.UpdateCluster(ctx, instance.Name, c.ClusterId, c.NumNodes); err != nil {
+				return fmt.Errorf("Error resizing cluster %q: %s", c.ClusterId, err)
+			}
+		}
+
+		for _, id := range toDelete {
+			if err = service.DeleteCluster(ctx, instance.Name, id); err != nil {
+				return fmt.Errorf("Error removing replica cluster %q: %s", id, err)
+			}
+		}
+
+		ii.Clusters = params.Clusters
+		ii.ClusterId = ""
+		ii.Zone = ""
+		ii.NumNodes = 0
+		ii.StorageType = ""
+
+	case params.NumNodes != nil:
+		if len(ii.Clusters) > 0 {
+			return fmt.Errorf("Error num_nodes cannot resize a replicated instance, supply clusters instead")
+		}
+		if ii.ClusterId == "" {
+			return fmt.Errorf("Error instance has no recorded cluster_id to resize")
+		}
+		if err = validateNumNodes(*params.NumNodes, maxNodes); err != nil {
+			return err
+		}
+
+		if err = service.UpdateCluster(ctx, instance.Name, ii.ClusterId, *params.NumNodes); err != nil {
+			return fmt.Errorf("Error resizing cluster %q: %s", ii.ClusterId, err)
+		}
+		ii.NumNodes = *params.NumNodes
+
+	default:
+		return nil
+	}
+
+	otherDetails, err := json.Marshal(ii)
+	if err != nil {
+		return fmt.Errorf("Error marshalling other details: %s", err)
+	}
+	instance.OtherDetails = string(otherDetails)
+
+	if err = db_service.DbConnection.Save(&instance).Error; err != nil {
+		return fmt.Errorf("Error persisting updated instance details: %s", err)
+	}
+
+	return nil
+}
+
 type BigtableDynamicPlan struct {
-	Guid        string `json:"guid"`
-	Name        string `json:"name"`
-	Description string `json:"description"`
-	NumNodes    string `json:"num_nodes"`
-	StorageType string `json:"storage_type"`
-	DisplayName string `json:"display_name"`
-	ServiceId   string `json:"service"`
+	Guid         string `json:"guid"`
+	Name         string `json:"name"`
+	Description  string `json:"description"`
+	NumNodes     string `json:"num_nodes"`
+	StorageType  string `json:"storage_type"`
+	InstanceType string `json:"instance_type"`
+	DisplayName  string `json:"display_name"`
+	ServiceId    string `json:"service"`
 }
 
 func MapPlan(details map[string]string) map[string]string {
@@ -175,5 +492,12 @@ func MapPlan(details map[string]string) map[string]string {
 		"num_nodes":    details["num_nodes"],
 		"storage_type": details["storage_type"],
 	}
+
+	if instanceType, ok := details["instance_type"]; ok && instanceType != "" {
+		features["instance_type"] = instanceType
+	} else {
+		features["instance_type"] = defaultInstanceType
+	}
+
 	return features
 }
@@ -0,0 +1,139 @@
+// Copyright the Service Broker Project Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+////////////////////////////////////////////////////////////////////////////////
+//
+
+package bigtable
+
+import (
+	"sort"
+	"testing"
+)
+
+func TestExistingClustersSeedsLegacySingleCluster(t *testing.T) {
+	ii := InstanceInformation{
+		ClusterId:   "my-instance-cluster",
+		Zone:        "us-east1-b",
+		NumNodes:    3,
+		StorageType: "SSD",
+	}
+
+	existing := existingClusters(ii)
+
+	cluster, ok := existing["my-instance-cluster"]
+	if !ok {
+		t.Fatalf("expected legacy cluster_id to be seeded into existing clusters, got %v", existing)
+	}
+	if cluster.Zone != "us-east1-b" || cluster.NumNodes != 3 || cluster.StorageType != "SSD" {
+		t.Fatalf("seeded cluster missing recorded fields: %+v", cluster)
+	}
+}
+
+func TestExistingClustersIncludesEveryListedCluster(t *testing.T) {
+	ii := InstanceInformation{
+		Clusters: []ClusterSpec{
+			{ClusterId: "c1", Zone: "us-east1-b", NumNodes: 3, StorageType: "SSD"},
+			{ClusterId: "c2", Zone: "us-west1-a", NumNodes: 5, StorageType: "HDD"},
+		},
+	}
+
+	existing := existingClusters(ii)
+
+	if len(existing) != 2 {
+		t.Fatalf("expected 2 existing clusters, got %d: %v", len(existing), existing)
+	}
+}
+
+func TestReconcileClustersCreatesResizesAndDeletes(t *testing.T) {
+	existing := map[string]ClusterSpec{
+		"my-instance-cluster": {ClusterId: "my-instance-cluster", Zone: "us-east1-b", NumNodes: 3, StorageType: "SSD"},
+		"c-stale":             {ClusterId: "c-stale", Zone: "us-east1-b", NumNodes: 3, StorageType: "SSD"},
+	}
+	desired := []ClusterSpec{
+		{ClusterId: "my-instance-cluster", Zone: "us-east1-b", NumNodes: 6, StorageType: "SSD"},
+		{ClusterId: "c-new", Zone: "us-west1-a", NumNodes: 3, StorageType: "HDD"},
+	}
+
+	toCreate, toUpdate, toDelete := reconcileClusters(existing, desired)
+
+	if len(toCreate) != 1 || toCreate[0].ClusterId != "c-new" {
+		t.Fatalf("expected c-new to be created, got %v", toCreate)
+	}
+	if len(toUpdate) != 1 || toUpdate[0].ClusterId != "my-instance-cluster" || toUpdate[0].NumNodes != 6 {
+		t.Fatalf("expected my-instance-cluster to be resized to 6 nodes, got %v", toUpdate)
+	}
+	if len(toDelete) != 1 || toDelete[0] != "c-stale" {
+		t.Fatalf("expected c-stale to be deleted, got %v", toDelete)
+	}
+}
+
+func TestReconcileClustersNoChangeWhenIdentical(t *testing.T) {
+	existing := map[string]ClusterSpec{
+		"c1": {ClusterId: "c1", Zone: "us-east1-b", NumNodes: 3, StorageType: "SSD"},
+	}
+	desired := []ClusterSpec{
+		{ClusterId: "c1", Zone: "us-east1-b", NumNodes: 3, StorageType: "SSD"},
+	}
+
+	toCreate, toUpdate, toDelete := reconcileClusters(existing, desired)
+
+	if len(toCreate) != 0 || len(toUpdate) != 0 || len(toDelete) != 0 {
+		t.Fatalf("expected no changes, got create=%v update=%v delete=%v", toCreate, toUpdate, toDelete)
+	}
+}
+
+func TestReconcileClustersIsOrderIndependent(t *testing.T) {
+	existing := map[string]ClusterSpec{
+		"a": {ClusterId: "a", NumNodes: 1},
+		"b": {ClusterId: "b", NumNodes: 1},
+		"c": {ClusterId: "c", NumNodes: 1},
+	}
+	desired := []ClusterSpec{
+		{ClusterId: "b", NumNodes: 1},
+		{ClusterId: "d", NumNodes: 1},
+	}
+
+	_, _, toDelete := reconcileClusters(existing, desired)
+
+	sort.Strings(toDelete)
+	if len(toDelete) != 2 || toDelete[0] != "a" || toDelete[1] != "c" {
+		t.Fatalf("expected a and c to be deleted, got %v", toDelete)
+	}
+}
+
+func TestValidateNumNodes(t *testing.T) {
+	cases := []struct {
+		name     string
+		numNodes int32
+		maxNodes int
+		wantErr  bool
+	}{
+		{"zero nodes rejected", 0, 0, true},
+		{"negative nodes rejected", -1, 10, true},
+		{"within unbounded plan", 30, 0, false},
+		{"within plan bound", 5, 10, false},
+		{"at plan bound", 10, 10, false},
+		{"exceeds plan bound", 11, 10, true},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			err := validateNumNodes(c.numNodes, c.maxNodes)
+			if (err != nil) != c.wantErr {
+				t.Fatalf("validateNumNodes(%d, %d) error = %v, wantErr %v", c.numNodes, c.maxNodes, err, c.wantErr)
+			}
+		})
+	}
+}
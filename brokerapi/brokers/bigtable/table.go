@@ -0,0 +1,252 @@
+// Copyright the Service Broker Project Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+////////////////////////////////////////////////////////////////////////////////
+//
+
+package bigtable
+
+import (
+	googlebigtable "cloud.google.com/go/bigtable"
+	"code.cloudfoundry.org/lager"
+	"encoding/json"
+	"fmt"
+	"gcp-service-broker/brokerapi/brokers/broker_base"
+	"gcp-service-broker/brokerapi/brokers/models"
+	"gcp-service-broker/db_service"
+	"golang.org/x/net/context"
+	"google.golang.org/api/option"
+	"net/http"
+	"time"
+)
+
+// TableBroker provisions individual Bigtable tables (and their column
+// families) inside an existing instance, analogous to Terraform's
+// google_bigtable_table resource. It is distinct from BigTableBroker, which
+// manages the lifecycle of the instance itself.
+type TableBroker struct {
+	Client    *http.Client
+	ProjectId string
+	Logger    lager.Logger
+
+	broker_base.BrokerBase
+}
+
+// GCRule describes the garbage-collection policy for a single column
+// family. When both MaxVersions and MaxAge are set they are combined as a
+// union, or as an intersection if Intersection is set; Union is not read,
+// since union is already the default.
+type GCRule struct {
+	MaxVersions  int    `json:"max_versions,omitempty"`
+	MaxAge       string `json:"max_age,omitempty"`
+	Union        bool   `json:"union,omitempty"`
+	Intersection bool   `json:"intersection,omitempty"`
+}
+
+// ColumnFamilyConfig describes a column family to create alongside the
+// table, with an optional GC rule.
+type ColumnFamilyConfig struct {
+	Name   string  `json:"name"`
+	GCRule *GCRule `json:"gc_rule,omitempty"`
+}
+
+type TableInstanceInformation struct {
+	InstanceId     string               `json:"instance_id"`
+	TableName      string               `json:"table_name"`
+	ColumnFamilies []ColumnFamilyConfig `json:"column_families,omitempty"`
+}
+
+// Creates a new table (and optional column families) inside the instance
+// identified by details.RawParameters.instance_id.
+func (b *TableBroker) Provision(instanceId string, details models.ProvisionDetails, plan models.PlanDetails) (models.ServiceInstanceDetails, error) {
+	var err error
+	var params map[string]json.RawMessage
+
+	if len(details.RawParameters) == 0 {
+		params = map[string]json.RawMessage{}
+	} else if err = json.Unmarshal(details.RawParameters, &params); err != nil {
+		return models.ServiceInstanceDetails{}, fmt.Errorf("Error unmarshalling parameters: %s", err)
+	}
+
+	var btInstanceId string
+	if err = unmarshalParam(params, "instance_id", &btInstanceId); err != nil {
+		return models.ServiceInstanceDetails{}, err
+	}
+	if btInstanceId == "" {
+		return models.ServiceInstanceDetails{}, fmt.Errorf("Error instance_id is required")
+	}
+
+	var tableName string
+	if err = unmarshalParam(params, "table_name", &tableName); err != nil {
+		return models.ServiceInstanceDetails{}, err
+	}
+	if tableName == "" {
+		return models.ServiceInstanceDetails{}, fmt.Errorf("Error table_name is required")
+	}
+
+	var columnFamilies []ColumnFamilyConfig
+	if raw, ok := params["column_families"]; ok {
+		if err = json.Unmarshal(raw, &columnFamilies); err != nil {
+			return models.ServiceInstanceDetails{}, fmt.Errorf("Error unmarshalling column_families: %s", err)
+		}
+	}
+
+	ctx := context.Background()
+	co := option.WithUserAgent(models.CustomUserAgent)
+	client, err := googlebigtable.NewAdminClient(ctx, b.ProjectId, btInstanceId, co)
+	if err != nil {
+		return models.ServiceInstanceDetails{}, fmt.Errorf("Error creating bigtable admin client: %s", err)
+	}
+
+	if err = client.CreateTable(ctx, tableName); err != nil {
+		return models.ServiceInstanceDetails{}, fmt.Errorf("Error creating new table: %s", err)
+	}
+
+	if err = provisionColumnFamilies(ctx, client, tableName, columnFamilies); err != nil {
+		// The table has no ServiceInstanceDetails recorded yet, so a failed
+		// partial create would otherwise leave an orphaned table the broker
+		// doesn't know about and can't retry past. Best-effort clean it up.
+		if delErr := client.DeleteTable(ctx, tableName); delErr != nil {
+			b.Logger.Error("bigtable-table-rollback-failed", delErr, lager.Data{"table_name": tableName})
+		}
+		return models.ServiceInstanceDetails{}, err
+	}
+
+	ii := TableInstanceInformation{
+		InstanceId:     btInstanceId,
+		TableName:      tableName,
+		ColumnFamilies: columnFamilies,
+	}
+
+	otherDetails, err := json.Marshal(ii)
+	if err != nil {
+		return models.ServiceInstanceDetails{}, fmt.Errorf("Error marshalling other details: %s", err)
+	}
+
+	i := models.ServiceInstanceDetails{
+		Name:         tableName,
+		Url:          "",
+		Location:     "",
+		OtherDetails: string(otherDetails),
+	}
+
+	return i, nil
+}
+
+// deletes the table associated with the given instanceID string
+func (b *TableBroker) Deprovision(instanceID string, details models.DeprovisionDetails) error {
+	instance := models.ServiceInstanceDetails{}
+	if err := db_service.DbConnection.Where("ID = ?", instanceID).First(&instance).Error; err != nil {
+		return models.ErrInstanceDoesNotExist
+	}
+
+	var ii TableInstanceInformation
+	if err := json.Unmarshal([]byte(instance.OtherDetails), &ii); err != nil {
+		return fmt.Errorf("Error unmarshalling other details: %s", err)
+	}
+
+	ctx := context.Background()
+	co := option.WithUserAgent(models.CustomUserAgent)
+	client, err := googlebigtable.NewAdminClient(ctx, b.ProjectId, ii.InstanceId, co)
+	if err != nil {
+		return fmt.Errorf("Error creating bigtable admin client: %s", err)
+	}
+
+	if err = client.DeleteTable(ctx, ii.TableName); err != nil {
+		return fmt.Errorf("Error deleting table: %s", err)
+	}
+
+	return nil
+}
+
+// provisionColumnFamilies creates each column family and applies its GC
+// policy, if any. Callers are responsible for rolling the table back if this
+// returns an error partway through.
+func provisionColumnFamilies(ctx context.Context, client *googlebigtable.AdminClient, tableName string, columnFamilies []ColumnFamilyConfig) error {
+	for _, cf := range columnFamilies {
+		if err := client.CreateColumnFamily(ctx, tableName, cf.Name); err != nil {
+			return fmt.Errorf("Error creating column family %q: %s", cf.Name, err)
+		}
+
+		if cf.GCRule == nil {
+			continue
+		}
+
+		policy, err := gcPolicyFromRule(*cf.GCRule)
+		if err != nil {
+			return err
+		}
+
+		if err = client.SetGCPolicy(ctx, tableName, cf.Name, policy); err != nil {
+			return fmt.Errorf("Error setting GC policy for column family %q: %s", cf.Name, err)
+		}
+	}
+
+	return nil
+}
+
+func gcPolicyFromRule(rule GCRule) (googlebigtable.GCPolicy, error) {
+	var policies []googlebigtable.GCPolicy
+
+	if rule.MaxVersions > 0 {
+		policies = append(policies, googlebigtable.MaxVersionsPolicy(rule.MaxVersions))
+	}
+
+	if rule.MaxAge != "" {
+		age, err := time.ParseDuration(rule.MaxAge)
+		if err != nil {
+			return nil, fmt.Errorf("Error parsing max_age: %s", err)
+		}
+		policies = append(policies, googlebigtable.MaxAgePolicy(age))
+	}
+
+	switch {
+	case len(policies) == 0:
+		return nil, fmt.Errorf("Error gc_rule requires at least one of max_versions or max_age")
+	case len(policies) == 1:
+		return policies[0], nil
+	case rule.Intersection:
+		return googlebigtable.IntersectionPolicy(policies...), nil
+	default:
+		return googlebigtable.UnionPolicy(policies...), nil
+	}
+}
+
+func unmarshalParam(params map[string]json.RawMessage, key string, out interface{}) error {
+	raw, ok := params[key]
+	if !ok {
+		return nil
+	}
+	if err := json.Unmarshal(raw, out); err != nil {
+		return fmt.Errorf("Error unmarshalling %s: %s", key, err)
+	}
+	return nil
+}
+
+type TableDynamicPlan struct {
+	Guid        string `json:"guid"`
+	Name        string `json:"name"`
+	Description string `json:"description"`
+	DisplayName string `json:"display_name"`
+	ServiceId   string `json:"service"`
+}
+
+// MapTablePlan mirrors MapPlan's role for the instance broker: it forwards
+// broker-tunable feature keys from a plan's details into the plan's Features
+// blob. Tables have no per-plan knobs analogous to num_nodes/storage_type,
+// and TableBroker.Provision does not read plan.Features, so there is
+// currently nothing to forward.
+func MapTablePlan(details map[string]string) map[string]string {
+	return map[string]string{}
+}
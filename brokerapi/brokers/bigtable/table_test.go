@@ -0,0 +1,95 @@
+// Copyright the Service Broker Project Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+////////////////////////////////////////////////////////////////////////////////
+//
+
+package bigtable
+
+import (
+	"encoding/json"
+	"testing"
+)
+
+func TestGCPolicyFromRuleRequiresAtLeastOneBound(t *testing.T) {
+	if _, err := gcPolicyFromRule(GCRule{}); err == nil {
+		t.Fatalf("expected an error for a gc_rule with neither max_versions nor max_age set")
+	}
+}
+
+func TestGCPolicyFromRuleRejectsInvalidMaxAge(t *testing.T) {
+	if _, err := gcPolicyFromRule(GCRule{MaxAge: "not-a-duration"}); err == nil {
+		t.Fatalf("expected an error for an unparseable max_age")
+	}
+}
+
+func TestGCPolicyFromRuleSingleCondition(t *testing.T) {
+	if _, err := gcPolicyFromRule(GCRule{MaxVersions: 2}); err != nil {
+		t.Fatalf("unexpected error for max_versions-only rule: %s", err)
+	}
+	if _, err := gcPolicyFromRule(GCRule{MaxAge: "720h"}); err != nil {
+		t.Fatalf("unexpected error for max_age-only rule: %s", err)
+	}
+}
+
+func TestGCPolicyFromRuleCombinedConditions(t *testing.T) {
+	if _, err := gcPolicyFromRule(GCRule{MaxVersions: 2, MaxAge: "720h"}); err != nil {
+		t.Fatalf("unexpected error for union of max_versions and max_age: %s", err)
+	}
+	if _, err := gcPolicyFromRule(GCRule{MaxVersions: 2, MaxAge: "720h", Intersection: true}); err != nil {
+		t.Fatalf("unexpected error for intersection of max_versions and max_age: %s", err)
+	}
+}
+
+func TestMapTablePlanHasNoFeaturesToForward(t *testing.T) {
+	details := map[string]string{
+		"guid":         "guid-1",
+		"name":         "table-plan",
+		"description":  "a table plan",
+		"display_name": "Table Plan",
+		"service":      "bigtable-table",
+	}
+
+	features := MapTablePlan(details)
+
+	if len(features) != 0 {
+		t.Fatalf("expected no features to forward, got %v", features)
+	}
+}
+
+func TestUnmarshalParamMissingKeyLeavesZeroValue(t *testing.T) {
+	params := map[string]json.RawMessage{}
+
+	var name string
+	if err := unmarshalParam(params, "name", &name); err != nil {
+		t.Fatalf("unexpected error for missing key: %s", err)
+	}
+	if name != "" {
+		t.Fatalf("expected zero value for missing key, got %q", name)
+	}
+}
+
+func TestUnmarshalParamArrayValue(t *testing.T) {
+	params := map[string]json.RawMessage{
+		"column_families": json.RawMessage(`[{"name":"cf1"},{"name":"cf2"}]`),
+	}
+
+	var columnFamilies []ColumnFamilyConfig
+	if err := unmarshalParam(params, "column_families", &columnFamilies); err != nil {
+		t.Fatalf("unexpected error unmarshalling column_families: %s", err)
+	}
+	if len(columnFamilies) != 2 || columnFamilies[0].Name != "cf1" || columnFamilies[1].Name != "cf2" {
+		t.Fatalf("unexpected column families: %+v", columnFamilies)
+	}
+}